@@ -11,28 +11,75 @@ import (
 import "git.torproject.org/pluggable-transports/goptlib.git"
 import "github.com/mattn/go-shellwords"
 
-// Represents a server transport plugin configuration like:
+// Represents a transport plugin configuration like:
 // 	ServerTransportPlugin MethodName exec Command
+// or
+// 	ClientTransportPlugin MethodName exec Command
 type ServerTransportPlugin struct {
 	MethodName string
 	Command    []string
 	Options    pt.Args
 }
 
+// TransportRole distinguishes the server side of a pluggable transport
+// (ServerTransportPlugin / ServerTransportOptions) from the client side
+// (ClientTransportPlugin / ClientTransportOptions). A single fogrc can
+// configure both, so that the same file describes both ends of a bridge
+// deployment.
+type TransportRole int
+
+const (
+	RoleServer TransportRole = iota
+	RoleClient
+)
+
 type Configuration struct {
-	// Map from method names to command strings.
+	// Map from method names to server-side command strings.
 	Transports map[string][]string
+	// Map from method names to client-side command strings.
+	ClientTransports map[string][]string
 	// Map from method names to ServerTransportOptions.
 	Options map[string]pt.Args
+	// Map from method names to ClientTransportOptions.
+	ClientOptions map[string]pt.Args
 	// Map from tor-friendly names like "obfs3_websocket" to systematic
-	// names like "obfs3|websocket".
+	// names like "obfs3|websocket". Shared between client and server
+	// transports.
 	Aliases map[string]string
+	// aliasFmts records, in order, the fmt= mode ("name" or "num") that
+	// each *TransportOptions line chose for an alias, so Validate can
+	// flag an alias whose lines disagree.
+	aliasFmts map[string][]aliasFmtRecord
+	// numOptionsErrors holds fmt=num chain-index-out-of-range problems
+	// found while parsing, for Validate to surface.
+	numOptionsErrors []*ConfigError
+}
+
+type aliasFmtRecord struct {
+	Fmt  string
+	Line int
+}
+
+// transports returns the Transports or ClientTransports map for role.
+func (conf *Configuration) transports(role TransportRole) map[string][]string {
+	if role == RoleClient {
+		return conf.ClientTransports
+	}
+	return conf.Transports
+}
+
+// options returns the Options or ClientOptions map for role.
+func (conf *Configuration) options(role TransportRole) map[string]pt.Args {
+	if role == RoleClient {
+		return conf.ClientOptions
+	}
+	return conf.Options
 }
 
-func (conf *Configuration) MethodNames() []string {
+func (conf *Configuration) MethodNames(role TransportRole) []string {
 	result := make([]string, 0)
 	// We understand all the single transports
-	for k, _ := range conf.Transports {
+	for k, _ := range conf.transports(role) {
 		result = append(result, k)
 	}
 	// and aliases.
@@ -50,37 +97,60 @@ func (conf *Configuration) ParseMethodName(methodName string) []string {
 	return strings.Split(methodName, "|")
 }
 
-func (conf *Configuration) PluginList(methodName string) ([]ServerTransportPlugin, error) {
+func (conf *Configuration) PluginList(methodName string, role TransportRole) ([]ServerTransportPlugin, error) {
 	names := conf.ParseMethodName(methodName)
+	transports := conf.transports(role)
+	options := conf.options(role)
 	stp := make([]ServerTransportPlugin, 0)
 	for _, name := range names {
-		command, ok := conf.Transports[name]
+		command, ok := transports[name]
 		if !ok {
 			return nil, errors.New(fmt.Sprintf("no transport named %q", name))
 		}
-		options := conf.Options[name]
-		stp = append(stp, ServerTransportPlugin{name, command, options})
+		stp = append(stp, ServerTransportPlugin{name, command, options[name]})
 	}
 	return stp, nil
 }
 
+// ServerPluginList is PluginList for RoleServer.
+func (conf *Configuration) ServerPluginList(methodName string) ([]ServerTransportPlugin, error) {
+	return conf.PluginList(methodName, RoleServer)
+}
+
+// ClientPluginList is PluginList for RoleClient.
+func (conf *Configuration) ClientPluginList(methodName string) ([]ServerTransportPlugin, error) {
+	return conf.PluginList(methodName, RoleClient)
+}
+
 // Initialize a configuration object
 func getConfiguration() (conf *Configuration) {
 	conf = new(Configuration)
 	conf.Transports = make(map[string][]string)
+	conf.ClientTransports = make(map[string][]string)
 	conf.Aliases = make(map[string]string)
 	conf.Options = make(map[string]pt.Args)
+	conf.ClientOptions = make(map[string]pt.Args)
+	conf.aliasFmts = make(map[string][]aliasFmtRecord)
 	return conf
 }
 
-// Reads a configuration file and returns the contents
+// Reads a configuration file, parses it and validates the result. Validation
+// is mandatory: a config that parses but fails Validate is still an error,
+// so that a typo in a chain is caught before tor is restarted against it.
 func ReadConfigFile(fileName string) (*Configuration, error) {
 	var contents []byte
 	contents, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Error reading configuration file %s contents.", fileName))
 	}
-	return ParseConfiguration(string(contents), getConfiguration())
+	config, err := ParseConfiguration(string(contents), getConfiguration())
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
 }
 
 // Parses a configuration string and fills the config object's fields with the requested Aliases and ServerTransportPlugins
@@ -94,9 +164,14 @@ func ParseConfiguration(configString string, config *Configuration) (*Configurat
 				return nil, errors.New(fmt.Sprintf("Line %v: \"%v\" was split incorrectly by shellwords. Error: %v", lineCounter, line, err))
 			}
 			if len(delimitedTokens) > 1 {
-				configLineType := delimitedTokens[0] // This can be either Alias or ServerTransportPlugin
+				configLineType := delimitedTokens[0] // This can be either Alias, a *TransportPlugin or a *TransportOptions line
 				if configLineType == "ServerTransportPlugin" {
-					err = parseTransportLine(config, delimitedTokens, lineCounter)
+					err = parseTransportLine(config, delimitedTokens, lineCounter, RoleServer)
+					if err != nil {
+						return nil, err
+					}
+				} else if configLineType == "ClientTransportPlugin" {
+					err = parseTransportLine(config, delimitedTokens, lineCounter, RoleClient)
 					if err != nil {
 						return nil, err
 					}
@@ -106,7 +181,12 @@ func ParseConfiguration(configString string, config *Configuration) (*Configurat
 						return nil, err
 					}
 				} else if configLineType == "ServerTransportOptions" {
-					err = parseTransportOptions(config, delimitedTokens, lineCounter)
+					err = parseTransportOptions(config, delimitedTokens, lineCounter, RoleServer)
+					if err != nil {
+						return nil, err
+					}
+				} else if configLineType == "ClientTransportOptions" {
+					err = parseTransportOptions(config, delimitedTokens, lineCounter, RoleClient)
 					if err != nil {
 						return nil, err
 					}
@@ -119,87 +199,117 @@ func ParseConfiguration(configString string, config *Configuration) (*Configurat
 	return config, nil
 }
 
-// Parses a ServerTransportPlugin line.
+// Parses a ServerTransportPlugin or ClientTransportPlugin line.
 // Ex: ServerTransportPlugin dummy obfsproxy --client T managed
-func parseTransportLine(config *Configuration, tokens []string, lineCounter int) error {
+// Ex: ClientTransportPlugin dummy obfsproxy --client T socks5
+func parseTransportLine(config *Configuration, tokens []string, lineCounter int, role TransportRole) error {
 	transportName := tokens[1]
 	transportCmdLine := tokens[2:]
-	if _, ok := config.Transports[transportName]; ok {
-		return errors.New(fmt.Sprintf("Configuration file has duplicate ServerTransportPlugin lines. Duplicate line is at line number %s", lineCounter))
+	transports := config.transports(role)
+	if _, ok := transports[transportName]; ok {
+		return errors.New(fmt.Sprintf("Configuration file has duplicate TransportPlugin lines for %s. Duplicate line is at line number %d", transportName, lineCounter))
 	}
-	config.Transports[transportName] = transportCmdLine
+	transports[transportName] = transportCmdLine
 	return nil
 }
 
-// Parses a ServerTransportOptions line.
-func parseTransportOptions(config *Configuration, tokens []string, lineCounter int) error {
-	chainName, ok := config.Aliases[tokens[1]]
-	optionsMap := make(map[string]pt.Args)
-	fmtKeyVal := strings.Split(tokens[2], "=")
+// Parses a ServerTransportOptions or ClientTransportOptions line.
+func parseTransportOptions(config *Configuration, tokens []string, lineCounter int, role TransportRole) error {
+	// ConfigError.Line counts from 1, since a Line of 0 means the error is
+	// not tied to a single line.
+	lineCounter++
+	if len(tokens) < 3 {
+		return &ConfigError{Line: lineCounter, Directive: "TransportOptions", Reason: "expected an alias name and a fmt= string"}
+	}
+	aliasName := tokens[1]
+	chainName, ok := config.Aliases[aliasName]
 	if !ok {
-		return errors.New(fmt.Sprintf("Chain %s does not have a corresponding Alias line. Check your fogrc.", tokens[1]))
+		return &ConfigError{Line: lineCounter, Directive: "TransportOptions", Reason: fmt.Sprintf("chain %q does not have a corresponding Alias line", aliasName)}
 	}
+	fmtKeyVal := strings.SplitN(tokens[2], "=", 2)
 	if fmtKeyVal[0] != "fmt" {
-		return errors.New(fmt.Sprintf("ServerTransportOptions line %s does not have fmt string after chain name", tokens))
+		return &ConfigError{Line: lineCounter, Directive: "TransportOptions", Reason: "missing fmt= string after chain name"}
 	}
-	if fmtKeyVal[1] == "name" {
-		err := parseNameTransportOptions(config, tokens, lineCounter, optionsMap)
-		if err != nil {
+	if len(fmtKeyVal) != 2 {
+		return &ConfigError{Line: lineCounter, Directive: "TransportOptions", Reason: "fmt= is missing a value"}
+	}
+	config.aliasFmts[aliasName] = append(config.aliasFmts[aliasName], aliasFmtRecord{fmtKeyVal[1], lineCounter})
+
+	optionsMap := make(map[string]pt.Args)
+	switch fmtKeyVal[1] {
+	case "name":
+		if err := parseNameTransportOptions(config, tokens, lineCounter, optionsMap); err != nil {
 			return err
 		}
-	} else if fmtKeyVal[1] == "num" {
-		err := parseNumTransportOptions(config, tokens, lineCounter, optionsMap, chainName)
-		if err != nil {
+	case "num":
+		if err := parseNumTransportOptions(config, tokens, lineCounter, optionsMap, chainName, aliasName); err != nil {
 			return err
 		}
+	default:
+		return &ConfigError{Line: lineCounter, Directive: "TransportOptions", Reason: fmt.Sprintf("unknown fmt=%q, want \"name\" or \"num\"", fmtKeyVal[1])}
+	}
+
+	// Merge into the existing map for this role rather than replacing it,
+	// so that *TransportOptions lines for different aliases in the same
+	// fogrc don't clobber each other's options.
+	options := config.options(role)
+	for ptName, opts := range optionsMap {
+		options[ptName] = opts
 	}
-	config.Options = optionsMap
 	return nil
 }
 
-// Parses a ServerTransportOptions in the format fog-n-k-v
-// Ex: "fog-0-key=val fog-0-key2=val2 fog-1-key=val fog-1-key2=val2"
-func parseNumTransportOptions(config *Configuration, tokens []string, lineCounter int, optionsMap map[string]pt.Args, chainName string) error {
+// Parses a ServerTransportOptions in Tor's standard wire format, using the
+// chain position in place of a transport name. An index outside the chain's
+// length is recorded on config and surfaced by Validate, rather than
+// aborting the parse, since it's a property of the whole chain and not of
+// this token in isolation.
+// Ex: "0:key=val;key2=val2;1:key=val;key2=val2"
+func parseNumTransportOptions(config *Configuration, tokens []string, lineCounter int, optionsMap map[string]pt.Args, chainName string, aliasName string) error {
 	pts := strings.Split(chainName, "|")
-	for _, pt_name := range pts {
-		opts := make(pt.Args)
-		optionsMap[pt_name] = opts
-	}
-	for _, option := range tokens[3:] {
-		indexStart := strings.Index(option, "fog-") + 4
-		indexEnd := strings.Index(option[indexStart:], "-",)
-		index, err := strconv.Atoi(option[indexStart:][:indexEnd])
-		if err != nil {
-			errors.New(fmt.Sprintf("ServerTransportOption line %s has unknown chain index %s in .", tokens, option))
+	if len(tokens) != 4 {
+		return &ConfigError{Line: lineCounter, Directive: "TransportOptions", Reason: fmt.Sprintf("expected a single options string, got %d", len(tokens)-3)}
+	}
+	decoded, err := decodeServerTransportOptions(tokens[3])
+	if err != nil {
+		return &ConfigError{Line: lineCounter, Directive: "TransportOptions", Reason: "could not decode options string", Cause: err}
+	}
+	for indexStr, opts := range decoded {
+		index, atoiErr := strconv.Atoi(indexStr)
+		if atoiErr != nil || index < 0 || index >= len(pts) {
+			config.numOptionsErrors = append(config.numOptionsErrors, &ConfigError{
+				Line:      lineCounter,
+				Directive: "TransportOptions",
+				Reason:    fmt.Sprintf("alias %q: chain index %q is outside the chain (length %d)", aliasName, indexStr, len(pts)),
+				Cause:     atoiErr,
+			})
+			continue
 		}
-		keyVal := strings.Split(option[indexStart:][indexEnd + 1:], "=")
 		ptName := pts[index]
-		optionsMap[ptName].Add(keyVal[0], keyVal[1])
+		if _, ok := optionsMap[ptName]; !ok {
+			optionsMap[ptName] = make(pt.Args)
+		}
+		for k, vs := range opts {
+			for _, v := range vs {
+				optionsMap[ptName].Add(k, v)
+			}
+		}
 	}
 	return nil
 }
 
-// Parses a ServerTransportOptions in the format pt=ptname key=val key2=val2&pt=ptname2 key=val key2=val2
-// Ex: "pt=ptname key=val key2=val2&pt=ptname user=key password=val"
+// Parses a ServerTransportOptions in Tor's standard wire format.
+// Ex: "ptname:key=val;key2=val2;ptname2:key=val;key2=val2"
 func parseNameTransportOptions(config *Configuration, tokens []string, lineCounter int, optionsMap map[string]pt.Args) error {
-	firstPTNameStr := strings.Split(tokens[3], "=")
-	if firstPTNameStr[0] != "pt" {
-		return errors.New(fmt.Sprintf("ServerTransportOptions line %s:%s does not have a pt name for the first set of options", lineCounter, tokens))
-	}
-	opts := make(pt.Args)
-	ptName := firstPTNameStr[1]
-	optionsMap[ptName] = opts
-	for _, option := range tokens[3:] {
-		log("%s", option)
-		if nextPt := strings.Index(option, "&"); nextPt > -1 {
-			ptName = strings.Split(option[nextPt + 1:], "=")[1]
-			opts = make(pt.Args)
-			optionsMap[ptName] = opts
-			option = option[:nextPt]
-		}
-		keyVal := strings.Split(option, "=")
-		optionsMap[ptName].Add(keyVal[0], keyVal[1])
-		log("pt_name %s KEY VAL %s", ptName, keyVal)
+	if len(tokens) != 4 {
+		return &ConfigError{Line: lineCounter, Directive: "TransportOptions", Reason: fmt.Sprintf("expected a single options string, got %d", len(tokens)-3)}
+	}
+	decoded, err := decodeServerTransportOptions(tokens[3])
+	if err != nil {
+		return &ConfigError{Line: lineCounter, Directive: "TransportOptions", Reason: "could not decode options string", Cause: err}
+	}
+	for ptName, opts := range decoded {
+		optionsMap[ptName] = opts
 	}
 	return nil
 }
@@ -211,11 +321,13 @@ func parseAliasLine(config *Configuration, tokens []string, lineCounter int) err
 	aliasName = tokens[1]
 	aliasPath = strings.Split(tokens[2], "|")
 	if _, hashed := config.Aliases[aliasName]; hashed {
-		return errors.New(fmt.Sprintf("Configuration file has duplicate Alias lines. Duplicate line is at line number %s", lineCounter))
+		return errors.New(fmt.Sprintf("Configuration file has duplicate Alias lines. Duplicate line is at line number %d", lineCounter))
 	}
 	for _, ptName := range aliasPath {
-		if _, hashed := config.Transports[ptName]; !hashed {
-			log("Transport map is missing pluggable transport %s needed for chain %s. Check your configuration file for a ServerTransportPlugin line can launch %s", ptName, aliasName, ptName)
+		_, serverHashed := config.Transports[ptName]
+		_, clientHashed := config.ClientTransports[ptName]
+		if !serverHashed && !clientHashed {
+			log("Transport map is missing pluggable transport %s needed for chain %s. Check your configuration file for a ServerTransportPlugin or ClientTransportPlugin line can launch %s", ptName, aliasName, ptName)
 		}
 	}
 	config.Aliases[aliasName] = tokens[2]
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseConfigurationMergesTransportOptionsAcrossAliases(t *testing.T) {
+	configString := `
+ServerTransportPlugin fog1 exec fog1
+ServerTransportPlugin fog2 exec fog2
+Alias chain1 fog1
+Alias chain2 fog2
+ServerTransportOptions chain1 fmt=name fog1:key=one
+ServerTransportOptions chain2 fmt=name fog2:key=two
+`
+	config, err := ParseConfiguration(configString, getConfiguration())
+	if err != nil {
+		t.Fatalf("ParseConfiguration failed: %v", err)
+	}
+	if got := config.Options["fog1"]["key"]; len(got) != 1 || got[0] != "one" {
+		t.Errorf("Options[fog1][key] = %v, want [one] (options for chain1 were dropped)", got)
+	}
+	if got := config.Options["fog2"]["key"]; len(got) != 1 || got[0] != "two" {
+		t.Errorf("Options[fog2][key] = %v, want [two]", got)
+	}
+}
+
+func TestParseTransportOptionsMalformedLinesDoNotPanic(t *testing.T) {
+	tests := []string{
+		"ServerTransportOptions chain1",           // missing fmt=
+		"ServerTransportOptions chain1 fmt",       // fmt with no "="
+		"ServerTransportOptions chain1 fmt=raw x", // unknown fmt mode
+	}
+	base := `
+ServerTransportPlugin fog1 exec fog1
+Alias chain1 fog1
+`
+	for _, line := range tests {
+		configString := base + line + "\n"
+		var cfgErr *ConfigError
+		_, err := ParseConfiguration(configString, getConfiguration())
+		if err == nil {
+			t.Errorf("ParseConfiguration(%q) succeeded, want an error", line)
+			continue
+		}
+		if !errors.As(err, &cfgErr) {
+			t.Errorf("ParseConfiguration(%q) = %v, want a *ConfigError", line, err)
+		}
+	}
+}
+
+func TestParseNumTransportOptionsIndexOutOfRangeDefersToValidate(t *testing.T) {
+	configString := `
+ServerTransportPlugin fog1 exec fog1
+Alias chain1 fog1
+ServerTransportOptions chain1 fmt=num 5:key=val
+`
+	config, err := ParseConfiguration(configString, getConfiguration())
+	if err != nil {
+		t.Fatalf("ParseConfiguration failed: %v", err)
+	}
+	var cfgErr *ConfigError
+	if err := config.Validate(); !errors.As(err, &cfgErr) {
+		t.Fatalf("Validate() = %v, want a *ConfigError for the out-of-range chain index", err)
+	}
+}
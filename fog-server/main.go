@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+var configPath = flag.String("f", "fogrc", "path to the fogrc configuration file")
+var checkConfig = flag.Bool("check", false, "parse and validate the configuration file, then exit without binding any sockets")
+
+func main() {
+	// "fog-server socks5 ..." runs the SOCKS5 client front-end instead of
+	// the managed-proxy server; it has its own flag set since its flags
+	// don't overlap cleanly with the server's.
+	if len(os.Args) > 1 && os.Args[1] == "socks5" {
+		runSocks5Command(os.Args[2:])
+		return
+	}
+
+	flag.Parse()
+
+	config, err := ReadConfigFile(*configPath)
+	if err != nil {
+		log("%s: %s", *configPath, err)
+		os.Exit(1)
+	}
+
+	if *checkConfig {
+		log("%s: configuration is valid", *configPath)
+		return
+	}
+
+	serve(config)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// serve launches every configured server-side transport as a managed
+// ServerTransportPlugin child process and blocks forever.
+func serve(config *Configuration) {
+	for _, methodName := range config.MethodNames(RoleServer) {
+		plugins, err := config.ServerPluginList(methodName)
+		if err != nil {
+			log("%s: %s", methodName, err)
+			continue
+		}
+		if err := launchServerTransports(plugins); err != nil {
+			log("%s: %s", methodName, err)
+		}
+	}
+	select {}
+}
+
+// launchServerTransports starts each plugin in a chain as a managed server
+// transport. Every plugin's ServerTransportOptions are forwarded to every
+// child via TOR_PT_SERVER_TRANSPORT_OPTIONS, encoded with
+// encodeServerTransportOptions so that values containing ':', ';', '=' or
+// '\' (e.g. forwarded credentials or URLs) survive the trip intact.
+func launchServerTransports(plugins []ServerTransportPlugin) error {
+	serverTransportOptions := encodeAllServerTransportOptions(plugins)
+	for _, stp := range plugins {
+		if len(stp.Command) == 0 {
+			continue
+		}
+		cmd := exec.Command(stp.Command[0], stp.Command[1:]...)
+		cmd.Env = append(os.Environ(),
+			"TOR_PT_MANAGEDTRANSPORT_VER=1",
+			"TOR_PT_SERVER_TRANSPORTS="+stp.MethodName,
+			"TOR_PT_SERVER_TRANSPORT_OPTIONS="+serverTransportOptions,
+		)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeAllServerTransportOptions joins every plugin's options into a single
+// TOR_PT_SERVER_TRANSPORT_OPTIONS value, in Tor's
+// "name:key=value;name:key=value;name2:key=value" wire format, with the
+// "name:" prefix repeated on every record as goptlib's parser requires.
+func encodeAllServerTransportOptions(plugins []ServerTransportPlugin) string {
+	var records []string
+	for _, stp := range plugins {
+		if len(stp.Options) == 0 {
+			continue
+		}
+		records = append(records, encodeServerTransportOptions(stp.MethodName, stp.Options))
+	}
+	return strings.Join(records, ";")
+}
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+import "git.torproject.org/pluggable-transports/goptlib.git"
+
+func TestEncodeAllServerTransportOptions(t *testing.T) {
+	plugins := []ServerTransportPlugin{
+		{MethodName: "fog1", Command: []string{"fog1"}, Options: pt.Args{"key": []string{"val;ue"}}},
+		{MethodName: "fog2", Command: []string{"fog2"}},
+	}
+	got := encodeAllServerTransportOptions(plugins)
+	want := `fog1:key=val\;ue`
+	if got != want {
+		t.Errorf("encodeAllServerTransportOptions(...) = %q, want %q", got, want)
+	}
+}
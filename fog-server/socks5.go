@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+import "git.torproject.org/pluggable-transports/goptlib.git"
+
+// This file implements a transport-agnostic client front-end, in the style
+// of shapeshifter-dispatcher's "pt_socks5" mode: it reads the same fogrc a
+// fog-server would, launches the ClientTransportPlugin chain named by an
+// Alias as child processes using Tor's managed-proxy client protocol, and
+// exposes the head of the chain as a local SOCKS5 listener (RFC 1928). This
+// lets the chaining logic in this module be driven by any SOCKS5-speaking
+// client, not just tor.
+//
+// Chains of more than one client transport are accepted by the config
+// loader but not yet wired up end to end here; runSocks5Command rejects
+// them explicitly rather than silently proxying through only the first hop.
+
+// clientTransport is a running ClientTransportPlugin child process along
+// with the SOCKS address it announced for accepting connections.
+type clientTransport struct {
+	Name         string
+	Cmd          *exec.Cmd
+	SocksVersion int // 4 or 5
+	SocksAddr    string
+}
+
+// launchClientTransport starts stp as a managed client transport and blocks
+// until it reports a CMETHOD line for stp.MethodName on stdout.
+func launchClientTransport(stp ServerTransportPlugin, stateDir string) (*clientTransport, error) {
+	if len(stp.Command) == 0 {
+		return nil, fmt.Errorf("client transport %q has no command configured", stp.MethodName)
+	}
+	cmd := exec.Command(stp.Command[0], stp.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"TOR_PT_MANAGEDTRANSPORT_VER=1",
+		"TOR_PT_CLIENT_TRANSPORTS="+stp.MethodName,
+		"TOR_PT_STATE_LOCATION="+stateDir,
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	ct := &clientTransport{Name: stp.MethodName, Cmd: cmd}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, version, addr, ok := parseCMethodLine(line); ok && name == stp.MethodName {
+			ct.SocksVersion = version
+			ct.SocksAddr = addr
+			return ct, nil
+		}
+		if line == "CMETHODS DONE" {
+			break
+		}
+	}
+	cmd.Process.Kill()
+	return nil, fmt.Errorf("client transport %q exited without announcing a CMETHOD", stp.MethodName)
+}
+
+// parseCMethodLine parses a managed-proxy line of the form
+// "CMETHOD <name> socks5 127.0.0.1:1234" or "CMETHOD <name> socks4 ...".
+func parseCMethodLine(line string) (name string, socksVersion int, addr string, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[0] != "CMETHOD" {
+		return "", 0, "", false
+	}
+	switch fields[2] {
+	case "socks5":
+		socksVersion = 5
+	case "socks4":
+		socksVersion = 4
+	default:
+		return "", 0, "", false
+	}
+	return fields[1], socksVersion, fields[3], true
+}
+
+// decodeClientTransportArgs parses a SOCKS username/password field in the
+// pluggable transports spec's client argument encoding: "key=value;key=value"
+// with '\' escaping ':', ';', '=' and '\' itself, same as
+// decodeServerTransportOptions but without a leading "transport:" prefix.
+func decodeClientTransportArgs(s string) (pt.Args, error) {
+	args := make(pt.Args)
+	if len(s) == 0 {
+		return args, nil
+	}
+	for _, record := range splitUnescaped(s, ';') {
+		if record == "" {
+			continue
+		}
+		idx := unescapedIndex(record, '=')
+		if idx < 0 {
+			return nil, fmt.Errorf("client transport args %q: %q is missing \"=\"", s, record)
+		}
+		key := unescapeServerTransportOptionToken(record[:idx])
+		value := unescapeServerTransportOptionToken(record[idx+1:])
+		args.Add(key, value)
+	}
+	return args, nil
+}
+
+// runSocks5Command implements the "fog-server socks5" subcommand: it reads a
+// fogrc, launches the client transport named by --method, and serves SOCKS5
+// on --listen.
+func runSocks5Command(args []string) {
+	flags := flag.NewFlagSet("socks5", flag.ExitOnError)
+	configPath := flags.String("f", "fogrc", "path to the fogrc configuration file")
+	methodName := flags.String("method", "", "Alias (or single transport name) to expose as a local SOCKS5 proxy")
+	listenAddr := flags.String("listen", "127.0.0.1:1080", "address to listen for SOCKS5 connections on")
+	flags.Parse(args)
+
+	if *methodName == "" {
+		log("-method is required")
+		os.Exit(1)
+	}
+
+	config, err := ReadConfigFile(*configPath)
+	if err != nil {
+		log("%s: %s", *configPath, err)
+		os.Exit(1)
+	}
+
+	plugins, err := config.ClientPluginList(*methodName)
+	if err != nil {
+		log("%s: %s", *methodName, err)
+		os.Exit(1)
+	}
+	if len(plugins) != 1 {
+		log("%s: chains of more than one client transport are not yet supported by the socks5 front-end", *methodName)
+		os.Exit(1)
+	}
+
+	stateDir, err := ioutil.TempDir("", "fog-client")
+	if err != nil {
+		log("failed to create state directory: %s", err)
+		os.Exit(1)
+	}
+	upstream, err := launchClientTransport(plugins[0], stateDir)
+	if err != nil {
+		log("failed to launch client transport %q: %s", plugins[0].MethodName, err)
+		os.Exit(1)
+	}
+	defer upstream.Cmd.Process.Kill()
+
+	ln, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		log("failed to listen on %s: %s", *listenAddr, err)
+		os.Exit(1)
+	}
+	log("fog-client socks5: listening on %s, forwarding to %q via %s", *listenAddr, upstream.Name, upstream.SocksAddr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log("accept failed: %s", err)
+			continue
+		}
+		go handleSocks5Conn(conn, upstream)
+	}
+}
+
+// handleSocks5Conn negotiates RFC 1928 SOCKS5 (no-auth or username/password)
+// with conn, then relays the requested connection through upstream, passing
+// any username/password auth along to upstream as per-connection pt.Args.
+func handleSocks5Conn(conn net.Conn, upstream *clientTransport) {
+	defer conn.Close()
+
+	args, err := socks5Handshake(conn)
+	if err != nil {
+		log("socks5 handshake with %s failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	target, err := socks5ReadRequest(conn)
+	if err != nil {
+		log("socks5 request from %s failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	upstreamConn, err := dialThroughTransport(upstream, target, args)
+	if err != nil {
+		log("failed to reach %s through %q: %s", target, upstream.Name, err)
+		socks5WriteReply(conn, 0x01) // general failure
+		return
+	}
+	defer upstreamConn.Close()
+
+	if err := socks5WriteReply(conn, 0x00); err != nil {
+		return
+	}
+
+	relay(conn, upstreamConn)
+}
+
+// socks5Handshake performs the RFC 1928 method negotiation. Username/password
+// (RFC 1929) is preferred over no-auth whenever the client offers it, since a
+// client that advertises 0x02 is signaling it may want to forward
+// per-connection pt.Args; picking no-auth first would silently drop them.
+func socks5Handshake(conn net.Conn) (pt.Args, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0x05 {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	hasNoAuth := false
+	hasUserPass := false
+	for _, m := range methods {
+		switch m {
+		case 0x00:
+			hasNoAuth = true
+		case 0x02:
+			hasUserPass = true
+		}
+	}
+
+	switch {
+	case hasUserPass:
+		if _, err := conn.Write([]byte{0x05, 0x02}); err != nil {
+			return nil, err
+		}
+		return socks5UserPassAuth(conn)
+	case hasNoAuth:
+		if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+			return nil, err
+		}
+		return make(pt.Args), nil
+	default:
+		conn.Write([]byte{0x05, 0xFF})
+		return nil, fmt.Errorf("client offered no acceptable authentication method")
+	}
+}
+
+// socks5UserPassAuth performs the RFC 1929 subnegotiation and decodes the
+// pluggable-transport client args carried in it. Per the pluggable
+// transports spec, args longer than the 255-byte username field continue
+// into the password field, so both are concatenated before decoding; a
+// password of a single NUL byte is the spec's placeholder for "unused" and
+// is dropped. This still caps forwardable args at 255+255 bytes, the most
+// the SOCKS5 username/password fields can carry.
+func socks5UserPassAuth(conn net.Conn) (pt.Args, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	uname := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, uname); err != nil {
+		return nil, err
+	}
+	plenBuf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plenBuf); err != nil {
+		return nil, err
+	}
+	passwd := make([]byte, plenBuf[0])
+	if _, err := io.ReadFull(conn, passwd); err != nil {
+		return nil, err
+	}
+
+	encoded := string(uname)
+	if !(len(passwd) == 1 && passwd[0] == 0x00) {
+		encoded += string(passwd)
+	}
+
+	args, err := decodeClientTransportArgs(encoded)
+	if err != nil {
+		conn.Write([]byte{0x01, 0x01})
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// socks5ReadRequest reads an RFC 1928 CONNECT request and returns the
+// requested "host:port".
+func socks5ReadRequest(conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != 0x05 {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	if header[1] != 0x01 {
+		return "", fmt.Errorf("unsupported SOCKS command %d, only CONNECT is supported", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case 0x01: // IPv4
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+	case 0x03: // domain name
+		lenBuf := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+			return "", err
+		}
+		name := make([]byte, lenBuf[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	case 0x04: // IPv6
+		addr := make([]byte, 16)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+	default:
+		return "", fmt.Errorf("unsupported SOCKS address type %d", header[3])
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBuf); err != nil {
+		return "", err
+	}
+	port := int(portBuf[0])<<8 | int(portBuf[1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// socks5WriteReply writes a minimal RFC 1928 reply (bound address 0.0.0.0:0)
+// with the given reply code.
+func socks5WriteReply(conn net.Conn, replyCode byte) error {
+	_, err := conn.Write([]byte{0x05, replyCode, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// dialThroughTransport connects to upstream's own SOCKS listener and asks it
+// to reach target, forwarding args as the connection's auth field.
+func dialThroughTransport(upstream *clientTransport, target string, args pt.Args) (net.Conn, error) {
+	conn, err := net.Dial("tcp", upstream.SocksAddr)
+	if err != nil {
+		return nil, err
+	}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if upstream.SocksVersion == 4 {
+		err = socks4Connect(conn, host, port, encodeClientTransportArgs(args))
+	} else {
+		err = socks5Connect(conn, host, port, encodeClientTransportArgs(args))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// encodeClientTransportArgs is the inverse of decodeClientTransportArgs.
+func encodeClientTransportArgs(args pt.Args) string {
+	var parts []string
+	for k, vs := range args {
+		for _, v := range vs {
+			parts = append(parts, escapeServerTransportOptionToken(k)+"="+escapeServerTransportOptionToken(v))
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// socks4Connect performs a SOCKS4a CONNECT, using userID as the USERID field.
+func socks4Connect(conn net.Conn, host string, port int, userID string) error {
+	var req []byte
+	req = append(req, 0x04, 0x01, byte(port>>8), byte(port))
+	req = append(req, 0, 0, 0, 1) // invalid IP to trigger SOCKS4a domain resolution
+	req = append(req, []byte(userID)...)
+	req = append(req, 0)
+	req = append(req, []byte(host)...)
+	req = append(req, 0)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x5A {
+		return fmt.Errorf("SOCKS4 connect failed, code %d", reply[1])
+	}
+	return nil
+}
+
+// socks5Connect performs a SOCKS5 CONNECT against conn, authenticating with
+// username/password if authArgs is non-empty.
+func socks5Connect(conn net.Conn, host string, port int, authArgs string) error {
+	methods := []byte{0x00}
+	if authArgs != "" {
+		methods = []byte{0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] == 0x02 {
+		var req []byte
+		req = append(req, 0x01, byte(len(authArgs)))
+		req = append(req, []byte(authArgs)...)
+		req = append(req, 0x00)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		authReply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, authReply); err != nil {
+			return err
+		}
+		if authReply[1] != 0x00 {
+			return fmt.Errorf("SOCKS5 authentication failed")
+		}
+	} else if reply[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 server rejected our authentication methods")
+	}
+
+	req := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	req = append(req, []byte(host)...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	connectReply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, connectReply); err != nil {
+		return err
+	}
+	if connectReply[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 connect failed, code %d", connectReply[1])
+	}
+	switch connectReply[3] {
+	case 0x01:
+		io.CopyN(ioutil.Discard, conn, 4+2)
+	case 0x03:
+		lenBuf := make([]byte, 1)
+		io.ReadFull(conn, lenBuf)
+		io.CopyN(ioutil.Discard, conn, int64(lenBuf[0])+2)
+	case 0x04:
+		io.CopyN(ioutil.Discard, conn, 16+2)
+	}
+	return nil
+}
+
+// relay copies data in both directions between a and b until both directions
+// have drained, rather than returning as soon as the first direction's io.Copy
+// sees EOF. Returning early would let the caller's deferred Close tear down
+// both conns while the other direction might still be delivering a response
+// (e.g. a client that half-closes its write side before the upstream has
+// finished sending); CloseWrite propagates each direction's EOF to its peer
+// so a half-closed side doesn't stall the other.
+func relay(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		if cw, ok := a.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		if cw, ok := b.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	wg.Wait()
+}
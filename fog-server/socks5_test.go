@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+)
+
+import "git.torproject.org/pluggable-transports/goptlib.git"
+
+func TestEncodeDecodeClientTransportArgsRoundTrip(t *testing.T) {
+	tests := []pt.Args{
+		{"key": []string{"value"}},
+		{"password": []string{"has;semicolons"}},
+		{"user": []string{`back\slash`}},
+		{"a": []string{"1"}, "b": []string{"2"}},
+	}
+	for _, want := range tests {
+		encoded := encodeClientTransportArgs(want)
+		got, err := decodeClientTransportArgs(encoded)
+		if err != nil {
+			t.Fatalf("decodeClientTransportArgs(%q) failed: %v", encoded, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("round trip of %v via %q produced %v", want, encoded, got)
+		}
+	}
+}
+
+// TestRelayDrainsBothDirectionsAfterHalfClose simulates a client that sends
+// its request and then half-closes its write side before the upstream has
+// sent its full response, the common request/response pattern this fixes.
+// relay must still deliver the rest of the upstream's response rather than
+// tearing down as soon as the client->upstream direction sees EOF.
+func TestRelayDrainsBothDirectionsAfterHalfClose(t *testing.T) {
+	proxyA, clientA := tcpPipe(t)
+	proxyB, clientB := tcpPipe(t)
+
+	relayDone := make(chan struct{})
+	go func() {
+		relay(proxyA, proxyB)
+		close(relayDone)
+	}()
+
+	if _, err := clientA.Write([]byte("request")); err != nil {
+		t.Fatalf("clientA.Write: %v", err)
+	}
+	if err := clientA.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("clientA.CloseWrite: %v", err)
+	}
+
+	req, err := ioutil.ReadAll(clientB)
+	if err != nil {
+		t.Fatalf("reading request on clientB: %v", err)
+	}
+	if !bytes.Equal(req, []byte("request")) {
+		t.Fatalf("clientB received %q, want %q", req, "request")
+	}
+
+	if _, err := clientB.Write([]byte("response")); err != nil {
+		t.Fatalf("clientB.Write: %v", err)
+	}
+	clientB.Close()
+
+	resp, err := ioutil.ReadAll(clientA)
+	if err != nil {
+		t.Fatalf("reading response on clientA: %v", err)
+	}
+	if !bytes.Equal(resp, []byte("response")) {
+		t.Fatalf("clientA received %q, want %q (response was truncated)", resp, "response")
+	}
+
+	<-relayDone
+}
+
+// tcpPipe returns a connected pair of loopback TCP conns, which (unlike
+// net.Pipe) support CloseWrite.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer ln.Close()
+
+	type acceptResult struct {
+		conn net.Conn
+		err  error
+	}
+	acceptCh := make(chan acceptResult, 1)
+	go func() {
+		conn, err := ln.Accept()
+		acceptCh <- acceptResult{conn, err}
+	}()
+
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	accepted := <-acceptCh
+	if accepted.err != nil {
+		t.Fatalf("ln.Accept: %v", accepted.err)
+	}
+	return accepted.conn, dialed
+}
+
+func TestParseCMethodLine(t *testing.T) {
+	name, version, addr, ok := parseCMethodLine("CMETHOD fog socks5 127.0.0.1:1984")
+	if !ok || name != "fog" || version != 5 || addr != "127.0.0.1:1984" {
+		t.Errorf("parseCMethodLine returned %q, %d, %q, %v", name, version, addr, ok)
+	}
+	if _, _, _, ok := parseCMethodLine("VERSION 1"); ok {
+		t.Errorf("parseCMethodLine accepted a non-CMETHOD line")
+	}
+}
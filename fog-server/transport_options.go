@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+import "git.torproject.org/pluggable-transports/goptlib.git"
+
+// This file implements Tor's standard escaping for the
+// ServerTransportOptions / TOR_PT_SERVER_TRANSPORT_OPTIONS wire format:
+// 	<transport>:<key>=<value>;<transport>:<key>=<value>;<transport2>:<key>=<value>
+// A backslash escapes the next rune, which lets keys and values contain
+// ':', ';', '=' and '\' themselves. The decoder also accepts a record with
+// no "<transport>:" prefix and files it under the previous record's
+// transport. See the pluggable transports
+// specification, section on ServerTransportOptions.
+
+// escapeServerTransportOptionToken escapes ':', ';', '=' and '\' in s with a
+// leading backslash so it can be safely embedded in the wire format.
+func escapeServerTransportOptionToken(s string) string {
+	var buf bytes.Buffer
+	for _, r := range s {
+		switch r {
+		case '\\', ':', ';', '=':
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// unescapeServerTransportOptionToken removes the backslash in front of any
+// escaped rune in s.
+func unescapeServerTransportOptionToken(s string) string {
+	var buf bytes.Buffer
+	escaped := false
+	for _, r := range s {
+		if escaped {
+			buf.WriteRune(r)
+			escaped = false
+			continue
+		}
+		if r == '\\' {
+			escaped = true
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// splitUnescaped splits s on runes equal to sep that are not preceded by an
+// unescaped backslash. Escape sequences are left intact in the returned
+// substrings; callers that want the unescaped text must run it through
+// unescapeServerTransportOptionToken.
+func splitUnescaped(s string, sep rune) []string {
+	var parts []string
+	var buf bytes.Buffer
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			buf.WriteRune('\\')
+			buf.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == sep:
+			parts = append(parts, buf.String())
+			buf.Reset()
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	if escaped {
+		buf.WriteRune('\\')
+	}
+	parts = append(parts, buf.String())
+	return parts
+}
+
+// unescapedIndex returns the byte index of the first occurrence of target in
+// s that is not escaped by a preceding backslash, or -1 if there is none.
+func unescapedIndex(s string, target rune) int {
+	escaped := false
+	for i, r := range s {
+		if escaped {
+			escaped = false
+			continue
+		}
+		if r == '\\' {
+			escaped = true
+			continue
+		}
+		if r == target {
+			return i
+		}
+	}
+	return -1
+}
+
+// encodeServerTransportOptions encodes a single transport's options in Tor's
+// ServerTransportOptions wire format: "methodName:key=value;methodName:key=value".
+// goptlib's parser requires every ";"-separated record to repeat the
+// "methodName:" prefix, so it is written on each record rather than once up
+// front. Keys are sorted before encoding so the output is deterministic.
+func encodeServerTransportOptions(methodName string, opts pt.Args) string {
+	escapedName := escapeServerTransportOptionToken(methodName)
+	keys := make([]string, 0, len(opts))
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var records []string
+	for _, k := range keys {
+		for _, v := range opts[k] {
+			var buf bytes.Buffer
+			buf.WriteString(escapedName)
+			buf.WriteByte(':')
+			buf.WriteString(escapeServerTransportOptionToken(k))
+			buf.WriteByte('=')
+			buf.WriteString(escapeServerTransportOptionToken(v))
+			records = append(records, buf.String())
+		}
+	}
+	return strings.Join(records, ";")
+}
+
+// decodeServerTransportOptions parses a string in Tor's ServerTransportOptions
+// wire format into a map from transport name to its options.
+func decodeServerTransportOptions(s string) (map[string]pt.Args, error) {
+	result := make(map[string]pt.Args)
+	if len(s) == 0 {
+		return result, nil
+	}
+	var transport string
+	for _, record := range splitUnescaped(s, ';') {
+		if record == "" {
+			continue
+		}
+		if idx := unescapedIndex(record, ':'); idx >= 0 {
+			transport = unescapeServerTransportOptionToken(record[:idx])
+			if _, ok := result[transport]; !ok {
+				result[transport] = make(pt.Args)
+			}
+			record = record[idx+1:]
+			if record == "" {
+				continue
+			}
+		}
+		if transport == "" {
+			return nil, errors.New(fmt.Sprintf("ServerTransportOptions %q: %q is missing a transport name", s, record))
+		}
+		idx := unescapedIndex(record, '=')
+		if idx < 0 {
+			return nil, errors.New(fmt.Sprintf("ServerTransportOptions %q: %q is missing \"=\"", s, record))
+		}
+		key := unescapeServerTransportOptionToken(record[:idx])
+		value := unescapeServerTransportOptionToken(record[idx+1:])
+		result[transport].Add(key, value)
+	}
+	return result, nil
+}
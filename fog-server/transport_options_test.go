@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+import "git.torproject.org/pluggable-transports/goptlib.git"
+
+func TestEncodeDecodeServerTransportOptionsRoundTrip(t *testing.T) {
+	tests := []struct {
+		methodName string
+		opts       pt.Args
+	}{
+		{"obfs3", pt.Args{"key": []string{"value"}}},
+		{"obfs3:chained", pt.Args{"url": []string{"http://example.com/path?a=b"}}},
+		{"fog", pt.Args{"cert": []string{"has;semicolons"}}},
+		{"fog", pt.Args{"password": []string{"col:on"}}},
+		{"fog", pt.Args{"path": []string{`back\slash`}}},
+		{"fog", pt.Args{"a": []string{"1"}, "b": []string{"2"}}},
+		{"weird name", pt.Args{"k": []string{"v"}}},
+	}
+	for _, test := range tests {
+		encoded := encodeServerTransportOptions(test.methodName, test.opts)
+		decoded, err := decodeServerTransportOptions(encoded)
+		if err != nil {
+			t.Fatalf("decodeServerTransportOptions(%q) failed: %v", encoded, err)
+		}
+		got, ok := decoded[test.methodName]
+		if !ok {
+			t.Fatalf("decodeServerTransportOptions(%q) = %v, missing method %q", encoded, decoded, test.methodName)
+		}
+		if !reflect.DeepEqual(got, test.opts) {
+			t.Errorf("round trip of %v via %q produced %v", test.opts, encoded, got)
+		}
+	}
+}
+
+func TestEncodeServerTransportOptionsRepeatsPrefixPerRecord(t *testing.T) {
+	// goptlib's parser treats TOR_PT_SERVER_TRANSPORT_OPTIONS as
+	// entry(;entry)*, where every entry must itself be "transport:key=value" —
+	// a bare "key=value" record with no transport prefix is rejected. So a
+	// transport with more than one option must repeat its "methodName:"
+	// prefix on every record, not just the first.
+	encoded := encodeServerTransportOptions("fog", pt.Args{"a": []string{"1"}, "b": []string{"2"}})
+	want := "fog:a=1;fog:b=2"
+	if encoded != want {
+		t.Errorf("encodeServerTransportOptions(...) = %q, want %q", encoded, want)
+	}
+	decoded, err := decodeServerTransportOptions(encoded)
+	if err != nil {
+		t.Fatalf("decodeServerTransportOptions(%q) failed: %v", encoded, err)
+	}
+	want2 := map[string]pt.Args{"fog": {"a": []string{"1"}, "b": []string{"2"}}}
+	if !reflect.DeepEqual(decoded, want2) {
+		t.Errorf("decodeServerTransportOptions(%q) = %v, want %v", encoded, decoded, want2)
+	}
+}
+
+func TestDecodeServerTransportOptionsMultipleTransports(t *testing.T) {
+	s := `fog:key=val\;ue;key2=val2;obfs3:a=b`
+	decoded, err := decodeServerTransportOptions(s)
+	if err != nil {
+		t.Fatalf("decodeServerTransportOptions(%q) failed: %v", s, err)
+	}
+	want := map[string]pt.Args{
+		"fog":   {"key": []string{"val;ue"}, "key2": []string{"val2"}},
+		"obfs3": {"a": []string{"b"}},
+	}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("decodeServerTransportOptions(%q) = %v, want %v", s, decoded, want)
+	}
+}
+
+func TestDecodeServerTransportOptionsErrors(t *testing.T) {
+	tests := []string{
+		"key=val",      // no transport name
+		"fog:keynoval", // no "="
+	}
+	for _, s := range tests {
+		if _, err := decodeServerTransportOptions(s); err == nil {
+			t.Errorf("decodeServerTransportOptions(%q) succeeded, want error", s)
+		}
+	}
+}
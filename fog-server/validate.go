@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConfigError describes a problem found while parsing or validating a fogrc
+// configuration. Line is 0 when the problem isn't tied to a single line
+// (e.g. a cross-reference found only after the whole file is read).
+type ConfigError struct {
+	Line      int
+	Directive string
+	Reason    string
+	Cause     error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("config line %d (%s): %s", e.Line, e.Directive, e.Reason)
+	}
+	return fmt.Sprintf("config (%s): %s", e.Directive, e.Reason)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Cause
+}
+
+// Validate checks a fully parsed Configuration for problems that can only
+// be seen once the whole file has been read: fmt=num chain indices outside
+// the chain they index into, aliases that name undefined transports,
+// aliases that duplicate another alias's target, and *TransportOptions
+// lines that disagree about an alias's fmt mode.
+func (conf *Configuration) Validate() error {
+	if len(conf.numOptionsErrors) > 0 {
+		return conf.numOptionsErrors[0]
+	}
+
+	aliasNames := make([]string, 0, len(conf.Aliases))
+	for name := range conf.Aliases {
+		aliasNames = append(aliasNames, name)
+	}
+	sort.Strings(aliasNames)
+
+	targetOwners := make(map[string]string)
+	for _, name := range aliasNames {
+		target := conf.Aliases[name]
+		if owner, ok := targetOwners[target]; ok {
+			return &ConfigError{
+				Directive: "Alias",
+				Reason:    fmt.Sprintf("alias %q duplicates the target of alias %q (%q)", name, owner, target),
+			}
+		}
+		targetOwners[target] = name
+
+		for _, ptName := range strings.Split(target, "|") {
+			_, serverOk := conf.Transports[ptName]
+			_, clientOk := conf.ClientTransports[ptName]
+			if !serverOk && !clientOk {
+				return &ConfigError{
+					Directive: "Alias",
+					Reason:    fmt.Sprintf("alias %q references undefined transport %q", name, ptName),
+				}
+			}
+		}
+	}
+
+	fmtNames := make([]string, 0, len(conf.aliasFmts))
+	for name := range conf.aliasFmts {
+		fmtNames = append(fmtNames, name)
+	}
+	sort.Strings(fmtNames)
+	for _, name := range fmtNames {
+		records := conf.aliasFmts[name]
+		for _, record := range records[1:] {
+			if record.Fmt != records[0].Fmt {
+				return &ConfigError{
+					Line:      record.Line,
+					Directive: "TransportOptions",
+					Reason:    fmt.Sprintf("alias %q mixes fmt=%s and fmt=%s", name, records[0].Fmt, record.Fmt),
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateUndefinedTransport(t *testing.T) {
+	config := getConfiguration()
+	config.Aliases["chain"] = "obfs3|missing"
+	config.Transports["obfs3"] = []string{"obfsproxy"}
+	var cfgErr *ConfigError
+	err := config.Validate()
+	if !errors.As(err, &cfgErr) {
+		t.Fatalf("Validate() = %v, want a *ConfigError", err)
+	}
+	if cfgErr.Directive != "Alias" {
+		t.Errorf("ConfigError.Directive = %q, want %q", cfgErr.Directive, "Alias")
+	}
+}
+
+func TestValidateDuplicateAliasTarget(t *testing.T) {
+	config := getConfiguration()
+	config.Transports["obfs3"] = []string{"obfsproxy"}
+	config.Aliases["a"] = "obfs3"
+	config.Aliases["b"] = "obfs3"
+	var cfgErr *ConfigError
+	err := config.Validate()
+	if !errors.As(err, &cfgErr) {
+		t.Fatalf("Validate() = %v, want a *ConfigError", err)
+	}
+}
+
+func TestValidateConflictingFmt(t *testing.T) {
+	config := getConfiguration()
+	config.Transports["obfs3"] = []string{"obfsproxy"}
+	config.Aliases["chain"] = "obfs3"
+	config.aliasFmts["chain"] = []aliasFmtRecord{{"name", 1}, {"num", 2}}
+	var cfgErr *ConfigError
+	err := config.Validate()
+	if !errors.As(err, &cfgErr) {
+		t.Fatalf("Validate() = %v, want a *ConfigError", err)
+	}
+	if cfgErr.Line != 2 {
+		t.Errorf("ConfigError.Line = %d, want 2", cfgErr.Line)
+	}
+}
+
+func TestValidateOk(t *testing.T) {
+	config := getConfiguration()
+	config.Transports["obfs3"] = []string{"obfsproxy"}
+	config.Aliases["chain"] = "obfs3"
+	if err := config.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+}